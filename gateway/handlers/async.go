@@ -0,0 +1,224 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/openfaas/faas/gateway/metrics"
+	"github.com/openfaas/faas/gateway/requests"
+)
+
+const callbackURLHeader = "X-Callback-Url"
+
+// MakeAsyncProxy creates a handler for POSTs to /async-function/{name} which
+// enqueues the request for later delivery instead of invoking the function
+// inline, giving callers fire-and-forget and fan-out semantics without
+// blocking on the function's own execution time.
+func MakeAsyncProxy(metrics metrics.Metrics, wildcard bool, queue Queue, logger *logrus.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var name string
+		if wildcard {
+			name = mux.Vars(r)["name"]
+		} else if header := r.Header["X-Function"]; len(header) > 0 {
+			name = header[0]
+		}
+
+		if len(name) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Provide an x-function header or valid route /async-function/function_name."))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		invocationID := newRequestID()
+
+		queued := QueuedRequest{
+			InvocationID: invocationID,
+			Function:     name,
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			QueryString:  r.URL.RawQuery,
+			Header:       r.Header.Clone(),
+			Body:         body,
+			CallbackURL:  r.Header.Get(callbackURLHeader),
+		}
+
+		if err := queue.Enqueue(queued); err != nil {
+			logger.WithFields(logrus.Fields{
+				"function_name": name,
+				"request_id":    invocationID,
+			}).WithError(err).Error("could not enqueue async invocation")
+
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("X-Call-Id", invocationID)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(invocationID))
+	}
+}
+
+// AsyncWorkerConfig tunes the pool of workers draining the async Queue.
+type AsyncWorkerConfig struct {
+	// Workers is how many goroutines concurrently dequeue and invoke.
+	Workers int
+
+	// CallbackRetries is how many additional attempts are made to deliver
+	// the response to CallbackURL after the first fails.
+	CallbackRetries int
+
+	// CallbackBackoff is the delay between callback delivery attempts.
+	CallbackBackoff time.Duration
+}
+
+// DefaultAsyncWorkerConfig is used when the gateway is constructed without
+// an explicit AsyncWorkerConfig.
+func DefaultAsyncWorkerConfig() AsyncWorkerConfig {
+	return AsyncWorkerConfig{
+		Workers:         4,
+		CallbackRetries: 2,
+		CallbackBackoff: 2 * time.Second,
+	}
+}
+
+// StartAsyncWorkers launches config.Workers goroutines draining queue,
+// invoking each request via the same resolver/balancer/breaker used by the
+// synchronous proxy, until ctx is cancelled.
+func StartAsyncWorkers(ctx context.Context, queue Queue, config AsyncWorkerConfig, metrics metrics.Metrics, resolver ServiceResolver, balancer Balancer, breaker *CircuitBreaker, logger *logrus.Logger) {
+	for i := 0; i < config.Workers; i++ {
+		go runAsyncWorker(ctx, queue, config, metrics, resolver, balancer, breaker, logger)
+	}
+}
+
+func runAsyncWorker(ctx context.Context, queue Queue, config AsyncWorkerConfig, metrics metrics.Metrics, resolver ServiceResolver, balancer Balancer, breaker *CircuitBreaker, logger *logrus.Logger) {
+	proxyClient := &http.Client{Timeout: 1 * time.Minute}
+
+	for {
+		queued, ack, err := queue.Dequeue(ctx)
+		if err != nil {
+			if err == context.Canceled || err == ErrQueueClosed {
+				return
+			}
+			continue
+		}
+
+		processAsyncInvocation(queued, config, metrics, resolver, balancer, breaker, logger, proxyClient)
+
+		if ackErr := ack(); ackErr != nil {
+			logger.WithFields(logrus.Fields{
+				"request_id":    queued.InvocationID,
+				"function_name": queued.Function,
+			}).WithError(ackErr).Error("could not ack async invocation")
+		}
+	}
+}
+
+func processAsyncInvocation(queued QueuedRequest, config AsyncWorkerConfig, metrics metrics.Metrics, resolver ServiceResolver, balancer Balancer, breaker *CircuitBreaker, logger *logrus.Logger, proxyClient *http.Client) {
+	path := queued.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	httpReq := &http.Request{
+		Method: queued.Method,
+		URL:    &url.URL{Path: path, RawQuery: queued.QueryString},
+		Header: queued.Header,
+		Body:   io.NopCloser(bytes.NewReader(queued.Body)),
+	}
+
+	forwardReq := requests.NewForwardRequest(httpReq.Method, *httpReq.URL)
+
+	recorder := httptest.NewRecorder()
+
+	allowed, retryAfter := breaker.Allow(queued.Function, logger)
+	if !allowed {
+		logger.WithFields(logrus.Fields{
+			"request_id":    queued.InvocationID,
+			"function_name": queued.Function,
+		}).Warn("circuit open, dropping async invocation")
+
+		recorder.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		recorder.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		invokeService(recorder, httpReq, metrics, queued.Function, forwardReq, logger, proxyClient, queued.InvocationID, resolver, balancer, breaker)
+	}
+
+	if len(queued.CallbackURL) == 0 {
+		return
+	}
+
+	deliverCallback(queued, recorder.Result(), config, logger)
+}
+
+// deliverCallback POSTs the function's response to the caller-supplied
+// callback URL, retrying on failure and logging to the dead-letter path
+// once retries are exhausted.
+func deliverCallback(queued QueuedRequest, response *http.Response, config AsyncWorkerConfig, logger *logrus.Logger) {
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	contentType := response.Header.Get("Content-Type")
+
+	var lastErr error
+	for attempt := 0; attempt <= config.CallbackRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(config.CallbackBackoff)
+		}
+
+		resp, err := http.Post(queued.CallbackURL, contentType, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < http.StatusInternalServerError {
+			return
+		}
+		lastErr = nil
+	}
+
+	logDeadLetter(queued, lastErr, logger)
+}
+
+// logDeadLetter records a callback that could not be delivered after all
+// retries. There is no persistent dead-letter store yet; this is the
+// point to wire one in once the gateway has somewhere to put it.
+func logDeadLetter(queued QueuedRequest, err error, logger *logrus.Logger) {
+	entry := logger.WithFields(logrus.Fields{
+		"request_id":    queued.InvocationID,
+		"function_name": queued.Function,
+		"callback_url":  queued.CallbackURL,
+		"dlq":           true,
+	})
+
+	if err != nil {
+		entry.WithError(err).Error("giving up on async callback delivery")
+	} else {
+		entry.Error("giving up on async callback delivery")
+	}
+}
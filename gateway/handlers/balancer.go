@@ -0,0 +1,210 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalancerStrategy selects how a Balancer picks between the endpoints
+// currently backing a function.
+type BalancerStrategy string
+
+const (
+	// RoundRobin cycles through endpoints in order.
+	RoundRobin BalancerStrategy = "round-robin"
+
+	// LeastOutstanding picks the endpoint with the fewest in-flight requests.
+	LeastOutstanding BalancerStrategy = "least-outstanding"
+
+	// PowerOfTwoChoices picks two endpoints at random and chooses the less loaded one.
+	PowerOfTwoChoices BalancerStrategy = "p2c"
+)
+
+// These constants configure when a Balancer temporarily stops picking an
+// endpoint that is failing, and when it gives that endpoint another try.
+const (
+	outlierWindow           = 20
+	outlierFailureThreshold = 0.5
+	outlierCooldown         = 10 * time.Second
+)
+
+// Balancer picks one of the endpoints currently backing a function,
+// tracking in-flight requests and rolling failure rates so it can spread
+// load and eject misbehaving endpoints.
+type Balancer interface {
+	// Pick selects an endpoint for name out of candidates, and returns a
+	// release func the caller must invoke with the outcome (true for
+	// success) once the request has completed.
+	Pick(name string, candidates []Endpoint) (Endpoint, func(ok bool), error)
+}
+
+// endpointState is the per-endpoint bookkeeping a Balancer uses to spread
+// load and to detect and eject an outlier.
+type endpointState struct {
+	outstanding int64
+
+	mu           sync.Mutex
+	requests     int
+	failures     int
+	ejectedUntil time.Time
+}
+
+func (s *endpointState) ejected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return time.Now().Before(s.ejectedUntil)
+}
+
+func (s *endpointState) recordResult(ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if !ok {
+		s.failures++
+	}
+
+	if s.requests < outlierWindow {
+		return
+	}
+
+	if float64(s.failures)/float64(s.requests) > outlierFailureThreshold {
+		s.ejectedUntil = time.Now().Add(outlierCooldown)
+	}
+
+	s.requests, s.failures = 0, 0
+}
+
+// balancer is the shared Balancer implementation backing every strategy;
+// only how it orders candidates in Pick differs.
+type balancer struct {
+	strategy BalancerStrategy
+
+	mu     sync.Mutex
+	states map[string]*endpointState
+	rrNext uint64
+}
+
+// NewBalancer creates a Balancer using the given strategy.
+func NewBalancer(strategy BalancerStrategy) Balancer {
+	return &balancer{
+		strategy: strategy,
+		states:   make(map[string]*endpointState),
+	}
+}
+
+func (b *balancer) stateFor(endpoint Endpoint) *endpointState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := fmt.Sprintf("%s:%d", endpoint.Address, endpoint.Port)
+	state, ok := b.states[key]
+	if !ok {
+		state = &endpointState{}
+		b.states[key] = state
+	}
+
+	return state
+}
+
+// Pick selects an endpoint for name out of candidates according to the
+// balancer's strategy, skipping any endpoint currently ejected as an
+// outlier unless every candidate is ejected.
+func (b *balancer) Pick(name string, candidates []Endpoint) (Endpoint, func(ok bool), error) {
+	if len(candidates) == 0 {
+		return Endpoint{}, nil, fmt.Errorf("no endpoints available for %s", name)
+	}
+
+	healthy := make([]Endpoint, 0, len(candidates))
+	for _, c := range candidates {
+		if !b.stateFor(c).ejected() {
+			healthy = append(healthy, c)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = candidates
+	}
+
+	var chosen Endpoint
+	switch b.strategy {
+	case LeastOutstanding:
+		chosen = b.pickLeastOutstanding(healthy)
+	case PowerOfTwoChoices:
+		chosen = b.pickPowerOfTwoChoices(healthy)
+	default:
+		chosen = b.pickRoundRobin(healthy)
+	}
+
+	state := b.stateFor(chosen)
+	atomic.AddInt64(&state.outstanding, 1)
+
+	var released int32
+	release := func(ok bool) {
+		if !atomic.CompareAndSwapInt32(&released, 0, 1) {
+			return
+		}
+		atomic.AddInt64(&state.outstanding, -1)
+		state.recordResult(ok)
+	}
+
+	return chosen, release, nil
+}
+
+func (b *balancer) pickRoundRobin(candidates []Endpoint) Endpoint {
+	i := atomic.AddUint64(&b.rrNext, 1)
+	return candidates[i%uint64(len(candidates))]
+}
+
+func (b *balancer) pickLeastOutstanding(candidates []Endpoint) Endpoint {
+	best := candidates[0]
+	bestLoad := atomic.LoadInt64(&b.stateFor(best).outstanding)
+
+	for _, c := range candidates[1:] {
+		load := atomic.LoadInt64(&b.stateFor(c).outstanding)
+		if load < bestLoad {
+			best, bestLoad = c, load
+		}
+	}
+
+	return best
+}
+
+func (b *balancer) pickPowerOfTwoChoices(candidates []Endpoint) Endpoint {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	first := candidates[randomInt(0, len(candidates))]
+	second := candidates[randomInt(0, len(candidates))]
+
+	if atomic.LoadInt64(&b.stateFor(second).outstanding) < atomic.LoadInt64(&b.stateFor(first).outstanding) {
+		return second
+	}
+
+	return first
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// balancerStrategyFromEnv reads the "balancer_strategy" env var, so
+// operators can pick a strategy per deployment. Defaults to RoundRobin.
+func balancerStrategyFromEnv() BalancerStrategy {
+	switch os.Getenv("balancer_strategy") {
+	case string(LeastOutstanding):
+		return LeastOutstanding
+	case string(PowerOfTwoChoices):
+		return PowerOfTwoChoices
+	default:
+		return RoundRobin
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBalancerRoundRobinCyclesEndpoints(t *testing.T) {
+	balancer := NewBalancer(RoundRobin)
+	candidates := []Endpoint{{Address: "a"}, {Address: "b"}, {Address: "c"}}
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(candidates); i++ {
+		endpoint, release, err := balancer.Pick("fn", candidates)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		seen[endpoint.Address] = true
+		release(true)
+	}
+
+	if len(seen) != len(candidates) {
+		t.Fatalf("expected round-robin to visit all %d candidates, saw %d", len(candidates), len(seen))
+	}
+}
+
+func TestBalancerPickErrorsWithNoCandidates(t *testing.T) {
+	balancer := NewBalancer(RoundRobin)
+
+	if _, _, err := balancer.Pick("fn", nil); err == nil {
+		t.Fatal("expected an error when no candidates are available")
+	}
+}
+
+func TestBalancerEjectsOutlierEndpoint(t *testing.T) {
+	balancer := NewBalancer(RoundRobin)
+	failing := Endpoint{Address: "failing"}
+	healthy := Endpoint{Address: "healthy"}
+	candidates := []Endpoint{failing, healthy}
+
+	// Drive the failing endpoint's failure ratio over outlierFailureThreshold
+	// across a full outlierWindow so it trips ejection.
+	for i := 0; i < outlierWindow; i++ {
+		_, release, err := balancer.Pick("fn", []Endpoint{failing})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		release(false)
+	}
+
+	for i := 0; i < 20; i++ {
+		endpoint, release, err := balancer.Pick("fn", candidates)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		release(true)
+
+		if endpoint.Address == failing.Address {
+			t.Fatal("expected the outlier endpoint to be skipped while a healthy candidate is available")
+		}
+	}
+}
+
+func TestBalancerFallsBackToEjectedEndpointWhenNoOthers(t *testing.T) {
+	balancer := NewBalancer(RoundRobin)
+	failing := Endpoint{Address: "failing"}
+
+	for i := 0; i < outlierWindow; i++ {
+		_, release, _ := balancer.Pick("fn", []Endpoint{failing})
+		release(false)
+	}
+
+	endpoint, release, err := balancer.Pick("fn", []Endpoint{failing})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	release(true)
+
+	if endpoint.Address != failing.Address {
+		t.Fatal("expected the only candidate to be picked even while ejected")
+	}
+}
+
+func TestEndpointStateEjectedUntilCooldownElapses(t *testing.T) {
+	state := &endpointState{}
+
+	for i := 0; i < outlierWindow; i++ {
+		state.recordResult(false)
+	}
+
+	if !state.ejected() {
+		t.Fatal("expected endpoint to be ejected after exceeding the failure threshold")
+	}
+
+	state.ejectedUntil = time.Now().Add(-time.Millisecond)
+	if state.ejected() {
+		t.Fatal("expected endpoint to no longer be ejected once the cooldown has passed")
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CircuitState is the state of a single function's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed allows all requests through and counts failures.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen fast-fails every request until CoolDown has elapsed.
+	CircuitOpen
+
+	// CircuitHalfOpen allows a limited number of trial requests through to
+	// decide whether to close the circuit again.
+	CircuitHalfOpen
+)
+
+// breakerStateGaugeOpts names the Prometheus gauge exposing each function's
+// breaker state, valued per the CircuitState iota (closed=0, open=1,
+// half-open=2), alongside the gateway's existing GatewayFunctionInvocation
+// metrics. gateway/metrics has no breaker-state series of its own to route
+// this through yet, so it's registered directly; see registerBreakerStateGauge.
+var breakerStateGaugeOpts = prometheus.GaugeOpts{
+	Namespace: "gateway",
+	Subsystem: "function",
+	Name:      "breaker_state",
+	Help:      "Current circuit breaker state per function (0=closed, 1=open, 2=half-open).",
+}
+
+// registerBreakerStateGauge registers a breaker-state gauge with the
+// default Prometheus registry. Every CircuitBreaker in a process shares the
+// same metric name and labels, so a second NewCircuitBreaker (e.g. in
+// tests) reuses the first's already-registered collector instead of
+// panicking via MustRegister.
+func registerBreakerStateGauge() *prometheus.GaugeVec {
+	gauge := prometheus.NewGaugeVec(breakerStateGaugeOpts, []string{"function_name"})
+
+	if err := prometheus.Register(gauge); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(*prometheus.GaugeVec); ok {
+				return existing
+			}
+		}
+	}
+
+	return gauge
+}
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerConfig tunes how aggressively a CircuitBreaker trips and recovers.
+type CircuitBreakerConfig struct {
+	// Window is the rolling period over which the failure ratio is measured.
+	Window time.Duration
+
+	// MinRequests is the minimum number of requests in Window before the
+	// failure ratio is considered meaningful enough to trip the breaker.
+	MinRequests int
+
+	// FailureThreshold is the failure ratio, in (0, 1], that trips the breaker.
+	FailureThreshold float64
+
+	// CoolDown is how long the breaker stays open before probing again.
+	CoolDown time.Duration
+
+	// HalfOpenMaxRequests caps how many trial requests are allowed through
+	// while half-open.
+	HalfOpenMaxRequests int
+}
+
+// DefaultCircuitBreakerConfig is used when the gateway is constructed
+// without an explicit CircuitBreakerConfig.
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Window:              10 * time.Second,
+		MinRequests:         10,
+		FailureThreshold:    0.5,
+		CoolDown:            15 * time.Second,
+		HalfOpenMaxRequests: 1,
+	}
+}
+
+// CircuitBreaker tracks one breaker per function, keyed by name, so a
+// single misbehaving function can't consume every gateway goroutine
+// waiting on it while leaving unrelated functions unaffected.
+type CircuitBreaker struct {
+	config     CircuitBreakerConfig
+	stateGauge *prometheus.GaugeVec
+
+	mu       sync.Mutex
+	breakers map[string]*functionBreaker
+}
+
+// NewCircuitBreaker creates a CircuitBreaker using the given config.
+func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config:     config,
+		stateGauge: registerBreakerStateGauge(),
+		breakers:   make(map[string]*functionBreaker),
+	}
+}
+
+type functionBreaker struct {
+	mu    sync.Mutex
+	state CircuitState
+
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	openedAt         time.Time
+	halfOpenInFlight int
+}
+
+func (b *CircuitBreaker) breakerFor(name string) *functionBreaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fb, ok := b.breakers[name]
+	if !ok {
+		fb = &functionBreaker{state: CircuitClosed, windowStart: time.Now()}
+		b.breakers[name] = fb
+	}
+
+	return fb
+}
+
+// Allow reports whether a request for name may proceed. When it returns
+// false, retryAfter is how long the caller should suggest the client wait.
+func (b *CircuitBreaker) Allow(name string, logger *logrus.Logger) (bool, time.Duration) {
+	fb := b.breakerFor(name)
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	switch fb.state {
+	case CircuitOpen:
+		if time.Since(fb.openedAt) < b.config.CoolDown {
+			return false, b.config.CoolDown - time.Since(fb.openedAt)
+		}
+
+		fb.transition(CircuitHalfOpen, name, logger, b.stateGauge)
+		fb.halfOpenInFlight = 1
+		return true, 0
+
+	case CircuitHalfOpen:
+		if fb.halfOpenInFlight >= b.config.HalfOpenMaxRequests {
+			return false, b.config.CoolDown
+		}
+
+		fb.halfOpenInFlight++
+		return true, 0
+
+	default:
+		return true, 0
+	}
+}
+
+// Report records the outcome of a request allowed through by Allow.
+func (b *CircuitBreaker) Report(name string, ok bool, logger *logrus.Logger) {
+	fb := b.breakerFor(name)
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	if fb.state == CircuitHalfOpen {
+		fb.halfOpenInFlight--
+
+		if ok {
+			fb.transition(CircuitClosed, name, logger, b.stateGauge)
+		} else {
+			fb.transition(CircuitOpen, name, logger, b.stateGauge)
+		}
+
+		return
+	}
+
+	if time.Since(fb.windowStart) > b.config.Window {
+		fb.windowStart = time.Now()
+		fb.requests, fb.failures = 0, 0
+	}
+
+	fb.requests++
+	if !ok {
+		fb.failures++
+	}
+
+	if fb.requests >= b.config.MinRequests && float64(fb.failures)/float64(fb.requests) >= b.config.FailureThreshold {
+		fb.transition(CircuitOpen, name, logger, b.stateGauge)
+	}
+}
+
+// transition moves the breaker to state, logging it and updating
+// stateGauge as a state transition.
+func (fb *functionBreaker) transition(state CircuitState, name string, logger *logrus.Logger, stateGauge *prometheus.GaugeVec) {
+	if fb.state == state {
+		return
+	}
+
+	previous := fb.state
+	fb.state = state
+
+	if state == CircuitOpen {
+		fb.openedAt = time.Now()
+	}
+	if state == CircuitClosed {
+		fb.requests, fb.failures = 0, 0
+		fb.windowStart = time.Now()
+	}
+
+	stateGauge.WithLabelValues(name).Set(float64(state))
+
+	if logger != nil {
+		logger.WithFields(logrus.Fields{
+			"function_name": name,
+			"from":          previous.String(),
+			"to":            state.String(),
+		}).Info("circuit breaker state change")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func testBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Window:              time.Minute,
+		MinRequests:         4,
+		FailureThreshold:    0.5,
+		CoolDown:            10 * time.Millisecond,
+		HalfOpenMaxRequests: 1,
+	}
+}
+
+func TestCircuitBreakerStaysClosedBelowFailureThreshold(t *testing.T) {
+	breaker := NewCircuitBreaker(testBreakerConfig())
+
+	for i := 0; i < 4; i++ {
+		allowed, _ := breaker.Allow("fn", nil)
+		if !allowed {
+			t.Fatalf("request %d: expected allowed while closed", i)
+		}
+		breaker.Report("fn", true, nil)
+	}
+
+	if allowed, _ := breaker.Allow("fn", nil); !allowed {
+		t.Fatal("expected breaker to remain closed after all-success window")
+	}
+}
+
+func TestCircuitBreakerOpensAtFailureThreshold(t *testing.T) {
+	breaker := NewCircuitBreaker(testBreakerConfig())
+
+	for i := 0; i < 4; i++ {
+		breaker.Allow("fn", nil)
+		breaker.Report("fn", false, nil)
+	}
+
+	allowed, retryAfter := breaker.Allow("fn", nil)
+	if allowed {
+		t.Fatal("expected breaker to be open after hitting the failure threshold")
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("expected a positive retryAfter while open, got %s", retryAfter)
+	}
+}
+
+func TestCircuitBreakerHalfOpensAfterCoolDown(t *testing.T) {
+	breaker := NewCircuitBreaker(testBreakerConfig())
+
+	for i := 0; i < 4; i++ {
+		breaker.Allow("fn", nil)
+		breaker.Report("fn", false, nil)
+	}
+
+	time.Sleep(breaker.config.CoolDown + 5*time.Millisecond)
+
+	allowed, _ := breaker.Allow("fn", nil)
+	if !allowed {
+		t.Fatal("expected one trial request to be allowed once half-open")
+	}
+
+	if allowed, _ := breaker.Allow("fn", nil); allowed {
+		t.Fatal("expected a second concurrent request to be refused while half-open")
+	}
+}
+
+func TestCircuitBreakerClosesOnSuccessfulHalfOpenTrial(t *testing.T) {
+	breaker := NewCircuitBreaker(testBreakerConfig())
+
+	for i := 0; i < 4; i++ {
+		breaker.Allow("fn", nil)
+		breaker.Report("fn", false, nil)
+	}
+
+	time.Sleep(breaker.config.CoolDown + 5*time.Millisecond)
+
+	breaker.Allow("fn", nil)
+	breaker.Report("fn", true, nil)
+
+	allowed, _ := breaker.Allow("fn", nil)
+	if !allowed {
+		t.Fatal("expected breaker to be closed again after a successful trial")
+	}
+}
+
+func TestCircuitBreakerReopensOnFailedHalfOpenTrial(t *testing.T) {
+	breaker := NewCircuitBreaker(testBreakerConfig())
+
+	for i := 0; i < 4; i++ {
+		breaker.Allow("fn", nil)
+		breaker.Report("fn", false, nil)
+	}
+
+	time.Sleep(breaker.config.CoolDown + 5*time.Millisecond)
+
+	breaker.Allow("fn", nil)
+	breaker.Report("fn", false, nil)
+
+	if allowed, _ := breaker.Allow("fn", nil); allowed {
+		t.Fatal("expected breaker to reopen after a failed half-open trial")
+	}
+}
+
+func TestCircuitBreakerTracksFunctionsIndependently(t *testing.T) {
+	breaker := NewCircuitBreaker(testBreakerConfig())
+
+	for i := 0; i < 4; i++ {
+		breaker.Allow("flaky", nil)
+		breaker.Report("flaky", false, nil)
+	}
+
+	if allowed, _ := breaker.Allow("flaky", nil); allowed {
+		t.Fatal("expected flaky to be open")
+	}
+	if allowed, _ := breaker.Allow("healthy", nil); !allowed {
+		t.Fatal("expected an unrelated function to be unaffected")
+	}
+}
+
+func TestNewCircuitBreakerReusesGaugeAcrossInstances(t *testing.T) {
+	first := NewCircuitBreaker(testBreakerConfig())
+	second := NewCircuitBreaker(testBreakerConfig())
+
+	if first.stateGauge != second.stateGauge {
+		t.Fatal("expected every CircuitBreaker to share the same registered gauge instead of colliding on registration")
+	}
+}
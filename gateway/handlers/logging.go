@@ -0,0 +1,74 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// LogConfig controls how the gateway's logger is constructed, so that log
+// verbosity and format can be tuned per-deployment without code changes.
+type LogConfig struct {
+	// Level is a logrus level name, e.g. "debug", "info", "warn".
+	Level string
+
+	// JSONFormat selects the JSON formatter, for shipping to ELK/Loki.
+	// When false, the human-readable text formatter is used.
+	JSONFormat bool
+
+	// SampleRate, keyed by function name, logs only 1 in every N
+	// per-request entries for that function. A missing or zero rate logs
+	// every request. Useful for functions invoked at very high volume.
+	SampleRate map[string]uint32
+}
+
+// activeLogConfig is set once at startup via SetLogConfig, and consulted by
+// the proxy handlers to decide whether to emit a per-request log entry. Its
+// zero value logs every request.
+var activeLogConfig LogConfig
+
+// SetLogConfig installs the LogConfig used by the proxy handlers. It should
+// be called once from the gateway's main, before serving traffic.
+func SetLogConfig(config LogConfig) {
+	activeLogConfig = config
+}
+
+// NewLogger builds a *logrus.Logger from the supplied LogConfig.
+func NewLogger(config LogConfig) *logrus.Logger {
+	logger := logrus.New()
+
+	level, err := logrus.ParseLevel(config.Level)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	logger.SetLevel(level)
+
+	if config.JSONFormat {
+		logger.Formatter = &logrus.JSONFormatter{}
+	} else {
+		logger.Formatter = &logrus.TextFormatter{}
+	}
+
+	return logger
+}
+
+var sampleCounts sync.Map
+
+// shouldLogRequest reports whether a per-request log entry for name should
+// be emitted under config's SampleRate, ticking the function's counter.
+func (config LogConfig) shouldLogRequest(name string) bool {
+	rate, ok := config.SampleRate[name]
+	if !ok || rate <= 1 {
+		return true
+	}
+
+	counterValue, _ := sampleCounts.LoadOrStore(name, new(uint64))
+	counter := counterValue.(*uint64)
+	n := atomic.AddUint64(counter, 1)
+
+	return n%uint64(rate) == 1
+}
@@ -6,6 +6,7 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
@@ -14,12 +15,7 @@ import (
 	"strconv"
 	"time"
 
-	"os"
-
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
 	"github.com/gorilla/mux"
 	"github.com/openfaas/faas/gateway/metrics"
 	"github.com/openfaas/faas/gateway/requests"
@@ -27,8 +23,12 @@ import (
 
 const watchdogPort = 8080
 
-// MakeProxy creates a proxy for HTTP web requests which can be routed to a function.
-func MakeProxy(metrics metrics.Metrics, wildcard bool, client *client.Client, logger *logrus.Logger) http.HandlerFunc {
+// MakeProxy creates a proxy for HTTP web requests which can be routed to a
+// function. balancer and breaker are accepted rather than constructed here
+// so the caller can pass the same instances into StartAsyncWorkers - without
+// that, the sync and async paths would trip independent breakers per
+// function and defeat the point of having one.
+func MakeProxy(metrics metrics.Metrics, wildcard bool, resolver ServiceResolver, balancer Balancer, breaker *CircuitBreaker, logger *logrus.Logger) http.HandlerFunc {
 	proxyClient := http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
@@ -40,20 +40,20 @@ func MakeProxy(metrics metrics.Metrics, wildcard bool, client *client.Client, lo
 			DisableKeepAlives:     true,
 			IdleConnTimeout:       120 * time.Millisecond,
 			ExpectContinueTimeout: 1500 * time.Millisecond,
+			// Force HTTP/1.1: upgraded (e.g. WebSocket) requests are proxied
+			// over a raw, hijacked connection and can't be multiplexed.
+			TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
 		},
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
+		requestID := getOrSetRequestID(w, r)
+
 		switch r.Method {
 		case "POST", "GET":
-			logger.Infoln(r.Header)
-
 			xFunctionHeader := r.Header["X-Function"]
-			if len(xFunctionHeader) > 0 {
-				logger.Debugln(xFunctionHeader)
-			}
 
 			// getServiceName
 			var serviceName string
@@ -65,8 +65,17 @@ func MakeProxy(metrics metrics.Metrics, wildcard bool, client *client.Client, lo
 				serviceName = xFunctionHeader[0]
 			}
 
+			if activeLogConfig.shouldLogRequest(serviceName) {
+				logger.WithFields(logrus.Fields{
+					"request_id":    requestID,
+					"function_name": serviceName,
+					"method":        r.Method,
+					"path":          r.URL.Path,
+				}).Debug("received request")
+			}
+
 			if len(serviceName) > 0 {
-				lookupInvoke(w, r, metrics, serviceName, client, logger, &proxyClient)
+				lookupInvoke(w, r, metrics, serviceName, resolver, balancer, breaker, logger, &proxyClient, requestID)
 			} else {
 				w.WriteHeader(http.StatusBadRequest)
 				w.Write([]byte("Provide an x-function header or valid route /function/function_name."))
@@ -78,77 +87,182 @@ func MakeProxy(metrics metrics.Metrics, wildcard bool, client *client.Client, lo
 	}
 }
 
-func lookupInvoke(w http.ResponseWriter, r *http.Request, metrics metrics.Metrics, name string, c *client.Client, logger *logrus.Logger, proxyClient *http.Client) {
-	exists, err := lookupSwarmService(name, c)
+func lookupInvoke(w http.ResponseWriter, r *http.Request, metrics metrics.Metrics, name string, resolver ServiceResolver, balancer Balancer, breaker *CircuitBreaker, logger *logrus.Logger, proxyClient *http.Client, requestID string) {
+	exists, err := resolver.Exists(context.Background(), name)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"request_id":    requestID,
+			"function_name": name,
+		}).WithError(err).Error("could not resolve service")
 
-	if err != nil || exists == false {
-		if err != nil {
-			logger.Errorf("Could not resolve service: %s error: %s.", name, err)
-		}
+		writeHead(name, metrics, http.StatusInternalServerError, w)
+		w.Write([]byte(fmt.Sprintf("Could not resolve service: %s.", name)))
+		return
+	}
 
+	if !exists {
 		// TODO: Should record the 404/not found error in Prometheus.
 		writeHead(name, metrics, http.StatusNotFound, w)
 		w.Write([]byte(fmt.Sprintf("Cannot find service: %s.", name)))
+		return
 	}
 
-	if exists {
-		defer trackTime(time.Now(), logger, metrics, name)
-		forwardReq := requests.NewForwardRequest(r.Method, *r.URL)
-
-		invokeService(w, r, metrics, name, forwardReq, logger, proxyClient)
+	allowed, retryAfter := breaker.Allow(name, logger)
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		writeHead(name, metrics, http.StatusServiceUnavailable, w)
+		w.Write([]byte(fmt.Sprintf("Circuit open for service: %s.", name)))
+		return
 	}
-}
 
-func lookupSwarmService(serviceName string, c *client.Client) (bool, error) {
-	fmt.Printf("Resolving: '%s'\n", serviceName)
-	serviceFilter := filters.NewArgs()
-	serviceFilter.Add("name", serviceName)
-	services, err := c.ServiceList(context.Background(), types.ServiceListOptions{Filters: serviceFilter})
+	forwardReq := requests.NewForwardRequest(r.Method, *r.URL)
 
-	return len(services) > 0, err
+	invokeService(w, r, metrics, name, forwardReq, logger, proxyClient, requestID, resolver, balancer, breaker)
 }
 
-func invokeService(w http.ResponseWriter, r *http.Request, metrics metrics.Metrics, service string, forwardReq requests.ForwardRequest, logger *logrus.Logger, proxyClient *http.Client) {
-	stamp := strconv.FormatInt(time.Now().Unix(), 10)
-
+func invokeService(w http.ResponseWriter, r *http.Request, metrics metrics.Metrics, service string, forwardReq requests.ForwardRequest, logger *logrus.Logger, proxyClient *http.Client, requestID string, resolver ServiceResolver, balancer Balancer, breaker *CircuitBreaker) {
+	var statusCode int
 	defer func(when time.Time) {
-		trackTime(when, logger, metrics, service)
+		trackTime(when, logger, metrics, service, requestID, statusCode)
 	}(time.Now())
 
-	//TODO: inject setting rather than looking up each time.
-	var dnsrr bool
-	if os.Getenv("dnsrr") == "true" {
-		dnsrr = true
+	if isUpgradeRequest(r) {
+		statusCode = invokeUpgrade(w, r, metrics, service, logger, requestID, resolver, balancer)
+		breaker.Report(service, statusCode == http.StatusSwitchingProtocols, logger)
+		return
 	}
 
-	addr := service
-	// Use DNS-RR via tasks.servicename if enabled as override, otherwise VIP.
-	if dnsrr {
-		entries, lookupErr := net.LookupIP(fmt.Sprintf("tasks.%s", service))
-		if lookupErr == nil && len(entries) > 0 {
-			index := randomInt(0, len(entries))
-			addr = entries[index].String()
-		}
+	retryPolicy := DefaultRetryPolicy()
+
+	if r.Body != nil {
+		defer r.Body.Close()
 	}
 
-	url := forwardReq.ToURL(addr, watchdogPort)
+	// Buffer the body, within the policy's cap, so a retry can replay it.
+	// Requests whose body is too large to buffer are only ever attempted once.
+	var bodyBytes []byte
+	var bodyTooLargeToReplay bool
+	if r.Body != nil {
+		limited := io.LimitReader(r.Body, retryPolicy.MaxBufferedBodyBytes+1)
+		buffered, readErr := io.ReadAll(limited)
+		if readErr == nil {
+			if int64(len(buffered)) > retryPolicy.MaxBufferedBodyBytes {
+				bodyTooLargeToReplay = true
+			}
+			bodyBytes = buffered
+		}
+	}
 
 	contentType := r.Header.Get("Content-Type")
-	logger.Infof("[%s] Forwarding request [%s] to: %s\n", stamp, contentType, url)
+	defaultHeader := "text/plain"
 
-	if r.Body != nil {
-		defer r.Body.Close()
+	var response *http.Response
+	var lastErr error
+	var cancelAttempt context.CancelFunc
+	maxAttempts := retryPolicy.MaxRetries + 1
+	if bodyTooLargeToReplay {
+		maxAttempts = 1
 	}
 
-	request, err := http.NewRequest(r.Method, url, r.Body)
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryPolicy.backoff(attempt - 1))
+		}
 
-	copyHeaders(&request.Header, &r.Header)
+		// Re-resolve on every attempt: a resolver backed by multiple
+		// endpoints (e.g. Swarm DNS-RR) gives a retry a chance to land on
+		// a different one.
+		endpoints, resolveErr := resolver.Resolve(context.Background(), service)
+		if resolveErr != nil || len(endpoints) == 0 {
+			lastErr = resolveErr
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no endpoints available for %s", service)
+			}
+			break
+		}
 
-	response, err := proxyClient.Do(request)
-	if err != nil {
-		logger.Errorln(err)
+		endpoint, release, pickErr := balancer.Pick(service, endpoints)
+		if pickErr != nil {
+			lastErr = pickErr
+			break
+		}
+
+		url := forwardReq.ToURL(endpoint.Address, endpoint.Port)
 
-		writeHead(service, metrics, http.StatusInternalServerError, w)
+		if activeLogConfig.shouldLogRequest(service) {
+			logger.WithFields(logrus.Fields{
+				"request_id":    requestID,
+				"function_name": service,
+				"upstream_addr": url,
+				"attempt":       attempt + 1,
+			}).Debugf("forwarding request, content-type: %s", contentType)
+		}
+
+		var bodyReader io.Reader
+		if bodyTooLargeToReplay {
+			// Forward the buffered prefix followed by the unread rest of the body.
+			bodyReader = io.MultiReader(bytes.NewReader(bodyBytes), r.Body)
+		} else if bodyBytes != nil {
+			bodyReader = bytes.NewReader(bodyBytes)
+		}
+
+		attemptCtx, cancel := context.WithTimeout(r.Context(), retryPolicy.PerAttemptTimeout)
+
+		request, err := http.NewRequestWithContext(attemptCtx, r.Method, url, bodyReader)
+		if err != nil {
+			cancel()
+			lastErr = err
+			break
+		}
+
+		copyHeaders(&request.Header, &r.Header)
+
+		resp, doErr := proxyClient.Do(request)
+		trackInvocationAttempt(service, logger, requestID, attempt+1)
+
+		if doErr != nil {
+			cancel()
+			release(false)
+			lastErr = doErr
+			response = nil
+			if attempt < maxAttempts-1 {
+				continue
+			}
+			break
+		}
+
+		retryable := retryPolicy.shouldRetryStatus(resp.StatusCode)
+		release(!retryable)
+
+		lastErr = nil
+		response = resp
+
+		if attempt < maxAttempts-1 && retryable {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			cancel()
+			continue
+		}
+
+		// This is the response we're keeping: hold its context open until
+		// the body has been streamed to the client below.
+		cancelAttempt = cancel
+		break
+	}
+
+	if lastErr != nil {
+		if cancelAttempt != nil {
+			cancelAttempt()
+		}
+
+		logger.WithFields(logrus.Fields{
+			"request_id":    requestID,
+			"function_name": service,
+		}).WithError(lastErr).Error("could not reach service")
+
+		statusCode = http.StatusInternalServerError
+		breaker.Report(service, false, logger)
+		writeHead(service, metrics, statusCode, w)
 		buf := bytes.NewBufferString("Can't reach service: " + service)
 		w.Write(buf.Bytes())
 		return
@@ -157,15 +271,18 @@ func invokeService(w http.ResponseWriter, r *http.Request, metrics metrics.Metri
 	clientHeader := w.Header()
 	copyHeaders(&clientHeader, &response.Header)
 
-	defaultHeader := "text/plain"
-
 	w.Header().Set("Content-Type", GetContentType(response.Header, r.Header, defaultHeader))
 
-	writeHead(service, metrics, response.StatusCode, w)
+	statusCode = response.StatusCode
+	breaker.Report(service, statusCode < http.StatusInternalServerError, logger)
+	writeHead(service, metrics, statusCode, w)
 
 	if response.Body != nil {
 		io.Copy(w, response.Body)
+		response.Body.Close()
 	}
+
+	cancelAttempt()
 }
 
 // GetContentType resolves the correct Content-Tyoe for a proxied function
@@ -193,8 +310,10 @@ func copyHeaders(destination *http.Header, source *http.Header) {
 	}
 }
 
+// randomInt returns a random integer in [min, max). The package-level
+// math/rand source is seeded once in balancer.go's init, rather than on
+// every call.
 func randomInt(min, max int) int {
-	rand.Seed(time.Now().Unix())
 	return rand.Intn(max-min) + min
 }
 
@@ -211,7 +330,22 @@ func trackInvocation(service string, metrics metrics.Metrics, code int) {
 	})
 }
 
-func trackTime(then time.Time, logger *logrus.Logger, metrics metrics.Metrics, name string) {
+// trackInvocationAttempt logs the outbound attempt number for an invocation,
+// so retried calls are visible without reusing GatewayFunctionInvocation's
+// {function_name, code} label schema under a disjoint label set.
+func trackInvocationAttempt(service string, logger *logrus.Logger, requestID string, attempt int) {
+	if !activeLogConfig.shouldLogRequest(service) {
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"request_id":    requestID,
+		"function_name": service,
+		"attempt":       attempt,
+	}).Debug("invocation attempt")
+}
+
+func trackTime(then time.Time, logger *logrus.Logger, metrics metrics.Metrics, name string, requestID string, statusCode int) {
 	since := time.Since(then)
 	metrics.GatewayFunctionsHistogram(map[string]string{
 		"function_name": name,
@@ -219,15 +353,29 @@ func trackTime(then time.Time, logger *logrus.Logger, metrics metrics.Metrics, n
 		since,
 	)
 
-	logger.Infof("[%s] took %f seconds\n", name, since.Seconds())
+	if activeLogConfig.shouldLogRequest(name) {
+		logger.WithFields(logrus.Fields{
+			"request_id":    requestID,
+			"function_name": name,
+			"status_code":   statusCode,
+			"duration_ms":   since.Milliseconds(),
+		}).Info("invocation complete")
+	}
 }
 
-func trackTimeExact(duration time.Duration, logger *logrus.Logger, metrics metrics.Metrics, name string) {
+func trackTimeExact(duration time.Duration, logger *logrus.Logger, metrics metrics.Metrics, name string, requestID string, statusCode int) {
 	metrics.GatewayFunctionsHistogram(map[string]string{
 		"function_name": name,
 	},
 		duration,
 	)
 
-	logger.Infof("[%s] took %f seconds\n", name, duration.Seconds())
+	if activeLogConfig.shouldLogRequest(name) {
+		logger.WithFields(logrus.Fields{
+			"request_id":    requestID,
+			"function_name": name,
+			"status_code":   statusCode,
+			"duration_ms":   duration.Milliseconds(),
+		}).Info("invocation complete")
+	}
 }
@@ -0,0 +1,103 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// QueuedRequest is a function invocation that has been accepted but not
+// yet executed, as enqueued by MakeAsyncProxy and consumed by an async worker.
+type QueuedRequest struct {
+	InvocationID string
+	Function     string
+	Method       string
+	Path         string
+	QueryString  string
+	Header       http.Header
+	Body         []byte
+
+	// CallbackURL, if set, receives the function's response once invoked.
+	CallbackURL string
+}
+
+// ErrQueueClosed is returned by Dequeue once the queue has been closed and drained.
+var ErrQueueClosed = errors.New("queue closed")
+
+// Queue is a pluggable destination for asynchronous invocations, so the
+// gateway isn't tied to any one broker.
+type Queue interface {
+	// Enqueue accepts req for later delivery.
+	Enqueue(req QueuedRequest) error
+
+	// Dequeue blocks until a request is available, ctx is cancelled, or the
+	// queue is closed. The returned ack must be called once req has been
+	// fully processed (invoked, and its callback delivered or
+	// dead-lettered) so an at-least-once backend only redelivers req if the
+	// gateway crashes before that point. ack is nil when err is non-nil.
+	Dequeue(ctx context.Context) (req QueuedRequest, ack func() error, err error)
+}
+
+// InMemoryQueue is a Queue backed by a buffered Go channel. It does not
+// survive a gateway restart, but needs no external broker - a reasonable
+// default for a single-replica gateway or for local development.
+type InMemoryQueue struct {
+	items chan QueuedRequest
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewInMemoryQueue creates an InMemoryQueue with room for capacity pending requests.
+func NewInMemoryQueue(capacity int) *InMemoryQueue {
+	return &InMemoryQueue{
+		items:  make(chan QueuedRequest, capacity),
+		closed: make(chan struct{}),
+	}
+}
+
+// Enqueue accepts req, blocking if the queue is at capacity.
+func (q *InMemoryQueue) Enqueue(req QueuedRequest) error {
+	select {
+	case <-q.closed:
+		return ErrQueueClosed
+	default:
+	}
+
+	select {
+	case q.items <- req:
+		return nil
+	case <-q.closed:
+		return ErrQueueClosed
+	}
+}
+
+// Dequeue blocks until a request is available, ctx is cancelled, or the
+// queue is closed and drained. There is nothing durable to ack: the request
+// is already gone from items, so ack is a no-op.
+func (q *InMemoryQueue) Dequeue(ctx context.Context) (QueuedRequest, func() error, error) {
+	select {
+	case req := <-q.items:
+		return req, func() error { return nil }, nil
+	case <-q.closed:
+		select {
+		case req := <-q.items:
+			return req, func() error { return nil }, nil
+		default:
+			return QueuedRequest{}, nil, ErrQueueClosed
+		}
+	case <-ctx.Done():
+		return QueuedRequest{}, nil, ctx.Err()
+	}
+}
+
+// Close stops accepting new requests; in-flight Dequeue calls return ErrQueueClosed.
+func (q *InMemoryQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	stan "github.com/nats-io/go-nats-streaming"
+)
+
+// NATSStreamingQueue is a Queue backed by a NATS Streaming durable
+// subscription, for gateways that need async invocations to survive a
+// restart and to fan out across gateway replicas.
+type NATSStreamingQueue struct {
+	conn    stan.Conn
+	subject string
+	durable string
+
+	deliveries chan natsDelivery
+}
+
+// natsDelivery pairs a decoded request with the raw message it came from,
+// so the message can be acked only once the request has been processed.
+type natsDelivery struct {
+	req QueuedRequest
+	msg *stan.Msg
+}
+
+// NewNATSStreamingQueue subscribes to subject as a durable queue group
+// member named durable, so each request is delivered to exactly one gateway replica.
+func NewNATSStreamingQueue(conn stan.Conn, subject, durable string) (*NATSStreamingQueue, error) {
+	q := &NATSStreamingQueue{
+		conn:       conn,
+		subject:    subject,
+		durable:    durable,
+		deliveries: make(chan natsDelivery, 64),
+	}
+
+	_, err := conn.QueueSubscribe(subject, durable, func(msg *stan.Msg) {
+		var req QueuedRequest
+		if jsonErr := json.Unmarshal(msg.Data, &req); jsonErr != nil {
+			return
+		}
+
+		// Not acked here: the message stays redeliverable until the
+		// caller's ack, returned from Dequeue, has been called.
+		q.deliveries <- natsDelivery{req: req, msg: msg}
+	}, stan.DurableName(durable), stan.SetManualAckMode())
+
+	if err != nil {
+		return nil, fmt.Errorf("could not subscribe to %s: %s", subject, err)
+	}
+
+	return q, nil
+}
+
+// Enqueue publishes req to the NATS Streaming subject.
+func (q *NATSStreamingQueue) Enqueue(req QueuedRequest) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return q.conn.Publish(q.subject, payload)
+}
+
+// Dequeue blocks until a request has been delivered by the subscription, or ctx is cancelled.
+func (q *NATSStreamingQueue) Dequeue(ctx context.Context) (QueuedRequest, func() error, error) {
+	select {
+	case d := <-q.deliveries:
+		return d.req, d.msg.Ack, nil
+	case <-ctx.Done():
+		return QueuedRequest{}, nil, ctx.Err()
+	}
+}
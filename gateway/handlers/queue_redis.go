@@ -0,0 +1,85 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStreamsQueue is a Queue backed by a Redis Stream, consumed via a
+// consumer group so multiple gateway replicas can share the work.
+type RedisStreamsQueue struct {
+	client   *redis.Client
+	stream   string
+	group    string
+	consumer string
+}
+
+// NewRedisStreamsQueue creates the consumer group (if it doesn't already
+// exist) and returns a Queue backed by stream.
+func NewRedisStreamsQueue(ctx context.Context, client *redis.Client, stream, group, consumer string) (*RedisStreamsQueue, error) {
+	err := client.XGroupCreateMkStream(ctx, stream, group, "$").Err()
+	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		return nil, fmt.Errorf("could not create consumer group %s on %s: %s", group, stream, err)
+	}
+
+	return &RedisStreamsQueue{
+		client:   client,
+		stream:   stream,
+		group:    group,
+		consumer: consumer,
+	}, nil
+}
+
+// Enqueue adds req to the stream as a single "payload" field.
+func (q *RedisStreamsQueue) Enqueue(req QueuedRequest) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return q.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: q.stream,
+		Values: map[string]interface{}{"payload": payload},
+	}).Err()
+}
+
+// Dequeue reads the next unclaimed entry for this consumer group. The
+// entry is left pending in the group - and so redeliverable to another
+// consumer - until the returned ack is called.
+func (q *RedisStreamsQueue) Dequeue(ctx context.Context) (QueuedRequest, func() error, error) {
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.group,
+		Consumer: q.consumer,
+		Streams:  []string{q.stream, ">"},
+		Count:    1,
+		Block:    0,
+	}).Result()
+
+	if err != nil {
+		return QueuedRequest{}, nil, err
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return QueuedRequest{}, nil, fmt.Errorf("no messages read from %s", q.stream)
+	}
+
+	message := streams[0].Messages[0]
+
+	var req QueuedRequest
+	if payload, ok := message.Values["payload"].(string); ok {
+		if jsonErr := json.Unmarshal([]byte(payload), &req); jsonErr != nil {
+			return QueuedRequest{}, nil, jsonErr
+		}
+	}
+
+	ack := func() error {
+		return q.client.XAck(context.Background(), q.stream, q.group, message.ID).Err()
+	}
+
+	return req, ack, nil
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// getOrSetRequestID returns the request ID supplied by the caller on the
+// X-Request-Id header, generating one and setting it on the request if none
+// was supplied. The ID is always set on the response. This lets an invocation be traced
+// across the gateway and function logs even when the caller doesn't
+// participate in the convention.
+func getOrSetRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if len(id) == 0 {
+		id = newRequestID()
+		r.Header.Set(requestIDHeader, id)
+	}
+
+	w.Header().Set(requestIDHeader, id)
+
+	return id
+}
+
+// newRequestID generates a random (version 4) UUID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
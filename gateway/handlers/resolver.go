@@ -0,0 +1,80 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Endpoint is a single resolved backend for a function.
+type Endpoint struct {
+	// Address is an IP address or hostname reachable on Port.
+	Address string
+
+	// Port is the watchdog port to call on Address.
+	Port int
+}
+
+// ServiceResolver discovers the backend(s) for a function by name. This
+// decouples the proxy path from any one orchestrator, so the gateway can
+// run against Docker Swarm, Kubernetes, or plain DNS.
+type ServiceResolver interface {
+	// Resolve returns the endpoints currently backing the named function.
+	Resolve(ctx context.Context, name string) ([]Endpoint, error)
+
+	// Exists reports whether name is a known, routable function. A non-nil
+	// error means the backend itself could not be queried, distinct from a
+	// definite "no such function" (false, nil).
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+// SwarmResolver resolves functions registered with a Docker Swarm cluster,
+// preserving the gateway's original behaviour: the service VIP by default,
+// or one of the tasks.<name> DNS-RR addresses when DNSRR is enabled.
+type SwarmResolver struct {
+	Client *client.Client
+	DNSRR  bool
+}
+
+// NewSwarmResolver creates a ServiceResolver backed by Docker Swarm.
+func NewSwarmResolver(c *client.Client, dnsrr bool) *SwarmResolver {
+	return &SwarmResolver{Client: c, DNSRR: dnsrr}
+}
+
+// Exists reports whether a Swarm service with this name has been created.
+func (s *SwarmResolver) Exists(ctx context.Context, name string) (bool, error) {
+	serviceFilter := filters.NewArgs()
+	serviceFilter.Add("name", name)
+	services, err := s.Client.ServiceList(ctx, types.ServiceListOptions{Filters: serviceFilter})
+	if err != nil {
+		return false, fmt.Errorf("could not list services for %s: %s", name, err)
+	}
+
+	return len(services) > 0, nil
+}
+
+// Resolve returns the service VIP, or the individual task IPs when DNSRR is enabled.
+func (s *SwarmResolver) Resolve(ctx context.Context, name string) ([]Endpoint, error) {
+	if !s.DNSRR {
+		return []Endpoint{{Address: name, Port: watchdogPort}}, nil
+	}
+
+	entries, err := net.LookupIP(fmt.Sprintf("tasks.%s", name))
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]Endpoint, 0, len(entries))
+	for _, entry := range entries {
+		endpoints = append(endpoints, Endpoint{Address: entry.String(), Port: watchdogPort})
+	}
+
+	return endpoints, nil
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNSResolver resolves functions via a DNS SRV lookup, for orchestrators
+// that publish function backends as SRV records (e.g. Consul, CoreDNS)
+// rather than an API the gateway can query directly.
+type DNSResolver struct {
+	// Domain is appended to the function name to form the SRV query, e.g.
+	// "service.consul" resolves "<name>.service.consul".
+	Domain string
+}
+
+// NewDNSResolver creates a ServiceResolver backed by DNS SRV lookups under domain.
+func NewDNSResolver(domain string) *DNSResolver {
+	return &DNSResolver{Domain: domain}
+}
+
+// Exists reports whether the SRV query for name returns at least one record.
+func (d *DNSResolver) Exists(ctx context.Context, name string) (bool, error) {
+	endpoints, err := d.Resolve(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return len(endpoints) > 0, nil
+}
+
+// Resolve performs a DNS SRV lookup for name and returns one Endpoint per record.
+func (d *DNSResolver) Resolve(ctx context.Context, name string) ([]Endpoint, error) {
+	query := name
+	if len(d.Domain) > 0 {
+		query = fmt.Sprintf("%s.%s", name, d.Domain)
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", query)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]Endpoint, 0, len(records))
+	for _, record := range records {
+		endpoints = append(endpoints, Endpoint{
+			Address: strings.TrimSuffix(record.Target, "."),
+			Port:    int(record.Port),
+		})
+	}
+
+	return endpoints, nil
+}
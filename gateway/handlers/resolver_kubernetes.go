@@ -0,0 +1,58 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// KubernetesResolver resolves functions to the ready Pod IPs backing the
+// Kubernetes Endpoints object for a Service named after the function.
+type KubernetesResolver struct {
+	Clientset *kubernetes.Clientset
+	Namespace string
+}
+
+// NewKubernetesResolver creates a ServiceResolver backed by the Kubernetes API.
+func NewKubernetesResolver(clientset *kubernetes.Clientset, namespace string) *KubernetesResolver {
+	return &KubernetesResolver{Clientset: clientset, Namespace: namespace}
+}
+
+// Exists reports whether a Service/Endpoints object exists for name.
+func (k *KubernetesResolver) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := k.Clientset.CoreV1().Endpoints(k.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not get endpoints for %s: %s", name, err)
+	}
+
+	return true, nil
+}
+
+// Resolve returns one Endpoint per ready address/port pair in the
+// function's Endpoints object.
+func (k *KubernetesResolver) Resolve(ctx context.Context, name string) ([]Endpoint, error) {
+	endpoints, err := k.Clientset.CoreV1().Endpoints(k.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve endpoints for %s: %s", name, err)
+	}
+
+	var resolved []Endpoint
+	for _, subset := range endpoints.Subsets {
+		for _, port := range subset.Ports {
+			for _, addr := range subset.Addresses {
+				resolved = append(resolved, Endpoint{Address: addr.IP, Port: int(port.Port)})
+			}
+		}
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how invokeService retries a transient failure when
+// calling through to a function's watchdog.
+type RetryPolicy struct {
+	// MaxRetries is the number of additional attempts made after the initial call.
+	MaxRetries int
+
+	// PerAttemptTimeout bounds how long a single attempt may take.
+	PerAttemptTimeout time.Duration
+
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the exponential backoff delay.
+	MaxBackoff time.Duration
+
+	// MaxBufferedBodyBytes limits how much of the request body is buffered
+	// so it can be replayed on retry. Requests with a larger body are only
+	// attempted once, since they cannot be safely replayed.
+	MaxBufferedBodyBytes int64
+
+	// RetryableStatusCodes are upstream status codes that should be retried.
+	RetryableStatusCodes map[int]bool
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used when none is supplied,
+// tuned for a single flaky Swarm task rather than a function that is
+// consistently failing.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:           2,
+		PerAttemptTimeout:    3 * time.Second,
+		InitialBackoff:       50 * time.Millisecond,
+		MaxBackoff:           1 * time.Second,
+		MaxBufferedBodyBytes: 5 * 1024 * 1024,
+		RetryableStatusCodes: map[int]bool{
+			http.StatusBadGateway:         true,
+			http.StatusServiceUnavailable: true,
+			http.StatusGatewayTimeout:     true,
+		},
+	}
+}
+
+// shouldRetryStatus reports whether the given upstream status code is
+// considered transient under this policy.
+func (p RetryPolicy) shouldRetryStatus(code int) bool {
+	return p.RetryableStatusCodes[code]
+}
+
+// backoff returns the delay to sleep before the given attempt (0-indexed),
+// as exponential backoff with full jitter, capped at MaxBackoff.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff * time.Duration(1<<uint(attempt))
+	if d > p.MaxBackoff || d <= 0 {
+		d = p.MaxBackoff
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
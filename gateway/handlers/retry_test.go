@@ -0,0 +1,75 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShouldRetryStatus(t *testing.T) {
+	policy := DefaultRetryPolicy()
+
+	retryable := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	for _, code := range retryable {
+		if !policy.shouldRetryStatus(code) {
+			t.Errorf("expected %d to be retryable", code)
+		}
+	}
+
+	notRetryable := []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError}
+	for _, code := range notRetryable {
+		if policy.shouldRetryStatus(code) {
+			t.Errorf("expected %d not to be retryable", code)
+		}
+	}
+}
+
+func TestBackoffCapsAtMaxBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     200 * time.Millisecond,
+	}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		if d := policy.backoff(attempt); d > policy.MaxBackoff {
+			t.Fatalf("attempt %d: backoff %s exceeded MaxBackoff %s", attempt, d, policy.MaxBackoff)
+		}
+	}
+}
+
+func TestBackoffWithinExponentialBound(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     time.Hour,
+	}
+
+	// With full jitter the draw is random, so assert on the deterministic
+	// upper bound (the un-jittered exponential delay) rather than the
+	// sampled value itself.
+	boundFor := func(attempt int) time.Duration {
+		return policy.InitialBackoff * time.Duration(int64(1)<<uint(attempt))
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		d := policy.backoff(attempt)
+		if d < 0 || d > boundFor(attempt) {
+			t.Fatalf("attempt %d: backoff %s outside [0, %s]", attempt, d, boundFor(attempt))
+		}
+	}
+}
+
+func TestBackoffNeverNegative(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 0,
+		MaxBackoff:     0,
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		if d := policy.backoff(attempt); d < 0 {
+			t.Fatalf("attempt %d: got negative backoff %s", attempt, d)
+		}
+	}
+}
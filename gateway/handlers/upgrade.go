@@ -0,0 +1,117 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/openfaas/faas/gateway/metrics"
+)
+
+// isUpgradeRequest reports whether r is asking to switch protocols, e.g. to
+// open a WebSocket connection to a function.
+func isUpgradeRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		len(r.Header.Get("Upgrade")) > 0
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// proxyUpgrade hijacks the client connection and dials the watchdog at
+// endpoint directly, forwarding the original request line and headers as
+// the handshake, then pipes bytes bidirectionally until either side
+// closes. This bypasses the retrying http.Client path entirely, since an
+// upgraded connection is stateful and cannot be replayed.
+func proxyUpgrade(w http.ResponseWriter, r *http.Request, endpoint Endpoint, logger *logrus.Logger, requestID string) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("response writer does not support hijacking")
+	}
+
+	upstreamAddr := fmt.Sprintf("%s:%d", endpoint.Address, endpoint.Port)
+	upstreamConn, err := net.Dial("tcp", upstreamAddr)
+	if err != nil {
+		return fmt.Errorf("could not dial watchdog at %s: %s", upstreamAddr, err)
+	}
+	defer upstreamConn.Close()
+
+	if err := r.Write(upstreamConn); err != nil {
+		return fmt.Errorf("could not forward handshake to %s: %s", upstreamAddr, err)
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		return fmt.Errorf("could not hijack client connection: %s", err)
+	}
+	defer clientConn.Close()
+
+	logger.WithFields(logrus.Fields{
+		"request_id":    requestID,
+		"upstream_addr": upstreamAddr,
+	}).Debug("switching protocols")
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(upstreamConn, clientBuf)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(clientConn, upstreamConn)
+		done <- struct{}{}
+	}()
+
+	<-done
+
+	return nil
+}
+
+// invokeUpgrade resolves a single endpoint and proxies an upgraded (e.g.
+// WebSocket) connection to it. It bypasses the retry path: once a
+// connection has been hijacked and handed off, there is nothing left to
+// retry. It returns the status code tracked for this invocation.
+func invokeUpgrade(w http.ResponseWriter, r *http.Request, metrics metrics.Metrics, service string, logger *logrus.Logger, requestID string, resolver ServiceResolver, balancer Balancer) int {
+	endpoints, err := resolver.Resolve(context.Background(), service)
+	if err != nil || len(endpoints) == 0 {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("Cannot find service: %s.", service)))
+		return http.StatusBadGateway
+	}
+
+	endpoint, release, err := balancer.Pick(service, endpoints)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return http.StatusBadGateway
+	}
+
+	if err := proxyUpgrade(w, r, endpoint, logger, requestID); err != nil {
+		release(false)
+		logger.WithFields(logrus.Fields{
+			"request_id":    requestID,
+			"function_name": service,
+		}).WithError(err).Error("could not proxy upgraded connection")
+
+		return http.StatusBadGateway
+	}
+
+	release(true)
+	return http.StatusSwitchingProtocols
+}